@@ -1,13 +1,34 @@
 from functions.bot import *
 from functions.cli import *
-from os import sys
+from functions.context import git_context, env_context, attach_context
+from functions.memory import remember, show_memory, forget, memory_context
+from functions.cache import clear_response_cache
+from functions.logManager import show_audit_log, write_crash_report
+from os import sys, environ
+import traceback
 
 def main():
     parser = argparse.ArgumentParser()
+    parser.add_argument('text', metavar='Text', nargs='*', help='(Optional) Free text, asked as a question or predicted as a command depending on DEFAULT_MODE')
     parser.add_argument('-w', metavar='Wiki', type=str, help='Get a wiki summary by title')
     parser.add_argument('-c', metavar='Command', type=str, help='Predict a command by text')
     parser.add_argument('-q', metavar='Question', type=str, help='Ask a question to the virtual assistant')
     parser.add_argument('-n', metavar='Token', type=int, help='(Optional) Number of tokens to predict')
+    parser.add_argument('-s', '--shell', metavar='Shell', choices=['bash', 'posix', 'fish', 'powershell'], help='(Optional) Shell to predict and run the command for: bash, posix, fish or powershell')
+    parser.add_argument('-g', '--git-context', action='store_true', help='(Optional) Add the git status, branch and last commits to the prompt')
+    parser.add_argument('-e', '--env-context', action='store_true', help='(Optional) Add the OS, shell and versions of tools named in the prompt, with secrets redacted')
+    parser.add_argument('--attach', metavar='File', action='append', help='(Optional) Add a file to the prompt, - reads stdin, can be repeated')
+    parser.add_argument('-a', action='store_true', help='List the audit log of executed commands')
+    parser.add_argument('-y', '--yes', action='store_true', help='(Optional) Run the predicted command without asking, same as --confirm never')
+    parser.add_argument('--confirm', metavar='Policy', choices=['always', 'dangerous', 'never'], help='(Optional) When to ask before running the command: always, dangerous or never')
+    parser.add_argument('--top-p', metavar='TopP', type=float, help='(Optional) Override the top-p sampling value from .env')
+    parser.add_argument('--stop', metavar='Stop', type=str, help='(Optional) Stop generating when this text appears')
+    parser.add_argument('--offline', action='store_true', help='(Optional) Fail right away instead of using the network, same as OFFLINE=YES')
+    parser.add_argument('--workspace', metavar='Name', help='Switch to the settings in .env.<Name>, or back to .env with default')
+    parser.add_argument('--remember', metavar='Fact', help='Remember a fact about you for every future prompt')
+    parser.add_argument('--memory', action='store_true', help='List the remembered facts')
+    parser.add_argument('--forget', metavar='Number', type=int, help='Forget the remembered fact with this number')
+    parser.add_argument('--clear-cache', action='store_true', help='Remove every cached response')
     args = parser.parse_args()
 
     try:
@@ -19,16 +40,64 @@ def main():
         showLogo()
         sys.exit(0)
 
+    if args.offline:
+        environ['OFFLINE'] = 'YES'
+
+    if args.workspace:
+        use_workspace(args.workspace)
+        sys.exit(0)
+
+    if args.clear_cache:
+        clear_response_cache()
+        sys.exit(0)
+
+    if args.remember:
+        remember(args.remember)
+        sys.exit(0)
+    elif args.memory:
+        show_memory()
+        sys.exit(0)
+    elif args.forget is not None:
+        forget(args.forget)
+        sys.exit(0)
+
+    context = memory_context(int(getenv('MEMORY_MAX_CHARS') or 500))
+    if args.git_context or getenv('GIT_CONTEXT') == 'YES':
+        context += git_context()
+    if args.env_context or getenv('ENV_CONTEXT') == 'YES':
+        context += env_context(args.c or args.q or ' '.join(args.text))
+    if args.attach:
+        context += attach_context(args.attach, int(getenv('ATTACH_MAX_CHARS') or 2000))
+
     if args.c:
-        run_llama_builder(args.c, 'C', args.n)
+        run_llama_builder(args.c, 'C', args.n, args.shell, context, 'never' if args.yes else args.confirm, args.top_p, args.stop)
         sys.exit(0)
     elif args.q:
-        run_llama_builder(args.q, 'Q', args.n)
+        run_llama_builder(args.q, 'Q', args.n, context=context, top_p=args.top_p, stop=args.stop)
         sys.exit(0)
     elif args.w:
         run_wiki_summary(args.w)
         sys.exit(0)
+    elif args.a:
+        show_audit_log()
+        sys.exit(0)
+    elif args.text:
+        # Free text without a flag goes to DEFAULT_MODE, Q for questions, C for commands or auto to guess
+        mode = getenv('DEFAULT_MODE')
+        if mode == 'auto':
+            mode = guess_mode(' '.join(args.text))
+            print(botPrint('Predicting a command' if mode == 'C' else 'Answering as a question', 'Grey'))
+        if mode == 'C':
+            run_llama_builder(' '.join(args.text), 'C', args.n, args.shell, context, 'never' if args.yes else args.confirm, args.top_p, args.stop)
+        else:
+            run_llama_builder(' '.join(args.text), 'Q', args.n, context=context, top_p=args.top_p, stop=args.stop)
+        sys.exit(0)
 
 
 if __name__ == "__main__":
-    main()
+    try:
+        main()
+    except Exception:
+        report = write_crash_report(traceback.format_exc())
+        print(botPrint(f'Something went wrong. A crash report was written to {report}, please attach it when opening an issue.', 'Red'))
+        sys.exit(1)
@@ -1,110 +1,329 @@
-from os import getenv, path, system
+from os import getenv, path, remove, environ
 from dotenv import load_dotenv
 import subprocess
+import re
+from shutil import which
 from .helpers import *
+from .logManager import write_audit_log
+from .context import unknown_flags, tools_context
+from .policy import load_policy
+from .cache import read_cached_response, write_cached_response
 from urllib.parse import quote
 from requests import get
 
 load_dotenv(override=True)
 
 llama_completion_dir = getenv("LLAMA_COMPLETION_DIR")
+
+# A workspace is a .env.<name> file in LLAMA_COMPLETION_DIR loaded on top of .env, e.g. .env.oncall
+def workspace_file():
+    return path.join(llama_completion_dir or '', 'workspace')
+
+def active_workspace():
+    if getenv('WORKSPACE'):
+        return getenv('WORKSPACE')
+    try:
+        with open(workspace_file(), encoding='utf-8') as file:
+            return file.read().strip()
+    except OSError:
+        return ''
+
+def use_workspace(name):
+    if name == 'default':
+        if path.exists(workspace_file()):
+            remove(workspace_file())
+        print(botPrint('Using the default settings from .env', 'Green'))
+        return
+    if not path.exists(path.join(llama_completion_dir or '', f'.env.{name}')):
+        print(botPrint(f'There is no .env.{name} file for the workspace {name}.', 'Red'))
+        exit(1)
+    with open(workspace_file(), 'w', encoding='utf-8') as file:
+        file.write(name + '\n')
+    print(botPrint(f'Using the workspace {name}', 'Green'))
+
+workspace = active_workspace()
+if workspace and not load_dotenv(path.join(llama_completion_dir or '', f'.env.{workspace}'), override=True):
+    print(botPrint(f'The workspace {workspace} has no .env.{workspace} file, using .env only.', 'Yellow'))
+
+# The policy file wins over .env and workspaces, redactions are added to the user's own
+locked_settings = load_policy()
+for name, value in locked_settings.items():
+    if name == 'ENV_CONTEXT_REDACT':
+        value = ','.join(filter(None, [getenv(name), value]))
+    environ[name] = value
+
 llama_cpp_dir = getenv("LLAMA_CPP_DIR")
 
-def run_command(command):
+# Name used in the command prompt and how to run a command in each supported shell
+shells = {
+    'bash': ('bash', ['bash', '-c']),
+    'posix': ('POSIX sh', ['sh', '-c']),
+    'fish': ('fish shell', ['fish', '-c']),
+    'powershell': ('PowerShell', ['pwsh', '-NoProfile', '-Command']),
+}
+
+def resolve_shell(shell = None):
+    shell = shell or getenv('C_SHELL') or 'bash'
+    if shell not in shells:
+        print(botPrint(f'Unknown shell {shell}, using bash instead.', 'Yellow'))
+        shell = 'bash'
+    return shell
+
+# always asks before every command, dangerous only before risky ones, never runs without asking
+confirm_policies = ['always', 'dangerous', 'never']
+
+def resolve_confirm_policy(policy = None):
+    if 'C_CONFIRM_POLICY' in locked_settings:
+        if policy and policy != locked_settings['C_CONFIRM_POLICY']:
+            print(botPrint(f"The policy file sets the confirmation policy to {locked_settings['C_CONFIRM_POLICY']}.", 'Yellow'))
+        return locked_settings['C_CONFIRM_POLICY']
+    policy = policy or getenv('C_CONFIRM_POLICY') or 'always'
+    if policy not in confirm_policies:
+        print(botPrint(f'Unknown confirmation policy {policy}, using always instead.', 'Yellow'))
+        policy = 'always'
+    return policy
+
+def run_command(command, description = '', shell = 'bash', policy = None, stdin = None):
 
     if command:
         print(botPrint('The command I think you want to run is: ') + botPrint(command, 'White'))
-        print(botPrint('Would you like to run this command? (y/N)', 'Yellow'))
-        user_input = input()
+        # Read-only mode shows the command but never runs it
+        if (getenv('READONLY') == 'YES'):
+            print(botPrint('Read-only mode is enabled, the command will not be run.', 'Yellow'))
+            exit()
 
-        if user_input == "Y" or user_input == "y":
+        policy = resolve_confirm_policy(policy)
+        assume_yes = policy == 'never' or (policy == 'dangerous' and not is_dangerous_command(command))
+
+        # Interactive commands always need an explicit answer, whatever the policy or -y
+        if is_interactive_command(command):
+            print(botPrint('Warning: this command is interactive and will wait for your input until you exit it.', 'Red'))
+            assume_yes = False
+
+        if confirm('Would you like to run this command?', assume_yes, stdin):
             print(botPrint('Running command: ') + botPrint(command, 'White'))
-            system(command)
-            exit()
+            exit_code = subprocess.call(shells[shell][1] + [command])
+            try:
+                write_audit_log(command, description, exit_code)
+            except OSError as error:
+                print(botPrint(f'Could not write the audit log: {error}', 'Red'))
+            exit(exit_code)
         else:
             print(botPrint("Okay, I won't run the command."))
             exit()
     else:
         print (botPrint('An error ocurred. Please, try again!', 'Red'))
 
-def generate_llama_prompt(prompt, option, Tokens = 100):
-    llama_model = path.join(llama_cpp_dir) + path.join(getenv(option + "_LLAMA_MODEL"))
+def shell_history_file(shell):
+    home = path.expanduser('~')
+    if getenv('HISTFILE'):
+        return getenv('HISTFILE')
+    if shell == 'fish':
+        return path.join(home, '.local', 'share', 'fish', 'fish_history')
+    if shell == 'powershell':
+        return path.join(home, '.local', 'share', 'powershell', 'PSReadLine', 'ConsoleHost_history.txt')
+    if (getenv('SHELL') or '').endswith('zsh'):
+        return path.join(home, '.zsh_history')
+    return path.join(home, '.bash_history')
+
+# Last commands from the shell history, only read when C_SHELL_HISTORY is set
+def read_shell_history(shell, count):
+    try:
+        with open(shell_history_file(shell), 'rb') as history:
+            # Only the tail matters, history files can grow large
+            history.seek(0, 2)
+            start = max(0, history.tell() - 65536)
+            history.seek(start)
+            lines = history.read().decode('utf-8', errors='replace').splitlines()
+            # Drop the line cut in half by seeking into the middle of the file
+            if start > 0:
+                lines = lines[1:]
+    except OSError:
+        return []
+
+    commands = []
+    for line in lines:
+        if shell == 'fish':
+            if not line.startswith('- cmd: '):
+                continue
+            line = line[len('- cmd: '):]
+        # zsh extended history lines look like ': 1700000000:0;ls -la'
+        line = re.sub(r'^: \d+:\d+;', '', line).strip()
+        if line and 'ask_llama.py' not in line:
+            commands.append(line)
+    return commands[-count:]
+
+# Long prompts or prompts with code go to _LLAMA_MODEL_LARGE when it is set
+def choose_model(prompt, option):
+    large_model = getenv(option + '_LLAMA_MODEL_LARGE')
+    if not large_model:
+        return getenv(option + '_LLAMA_MODEL')
+
+    threshold = int(getenv(option + '_LARGE_MODEL_CHARS') or 300)
+    has_code = re.search(r'```|[{};]\s*$|^\s*(def|class|function|import|#include)\b|Traceback', prompt, re.M) is not None
+    model = large_model if len(prompt) > threshold or has_code else getenv(option + '_LLAMA_MODEL')
+    print(botPrint(f'Using {path.basename(model)}', 'Grey'))
+    return model
+
+# Text passed to llama.cpp with -p, which it also echoes back before generating
+def build_prompt_text(prompt, option, shell = 'bash', context = ''):
+    # Only mention preferred tools that are actually installed
+    preferred_tools = [tool.strip() for tool in (getenv(option + '_PREFERRED_TOOLS') or '').split(',')]
+    preferred_tools = [tool for tool in preferred_tools if tool and which(tool)]
+    if preferred_tools:
+        context += 'Prefer these installed tools when they fit: ' + ', '.join(preferred_tools) + '.\n'
+
+    probe = [tool.strip() for tool in (getenv(option + '_PROBE_TOOLS') or '').split(',') if tool.strip()]
+    if probe:
+        context += tools_context(probe, int(getenv('PROBE_TOOLS_TTL') or 86400))
+
+    history_count = getenv(option + '_SHELL_HISTORY')
+    if history_count and history_count.isdigit() and int(history_count) > 0:
+        history = read_shell_history(shell, int(history_count))
+        if history:
+            context += 'Recently run commands:\n' + ''.join(f'$ {(command)}\n' for command in history) + '\n'
+
+    return (
+        context
+        + getenv(option + '_TEXT_START').replace(r'\n', '\n').replace('{shell}', shells[shell][0])
+        + prompt
+        + getenv(option + '_TEXT_END').replace(r'\n', '\n')
+    )
+
+def generate_llama_prompt(prompt, option, Tokens = 100, shell = 'bash', context = '', top_p = None):
+    llama_model = path.join(llama_cpp_dir) + path.join(choose_model(context + prompt, option))
     gpu = getenv('GPU')
     gpu_layers = ''
+    top_p = top_p if top_p is not None else getenv(option + '_TOP_P')
     
     if (gpu == 'YES'):
         layers = getenv('GPU_LAYERS')
         gpu_layers = f"--n-gpu-layers = {(layers)} "
 
+    # Optional sampling parameters, only passed when set in .env
+    sampling = ''
+    for env_name, flag in [('_SEED', '--seed'), ('_PRESENCE_PENALTY', '--presence-penalty'), ('_FREQUENCY_PENALTY', '--frequency-penalty')]:
+        value = getenv(option + env_name)
+        if value:
+            sampling += f"{(flag)} {(value)} "
+
+    # The grammar only lets llama.cpp write one line followed by the delimiter, e.g. root ::= [^`\n]+ "`"
+    grammar = ''
+    delimiter = str(getenv(option + '_TEXT_DELIMITER'))
+    if getenv(option + '_GRAMMAR') == 'YES':
+        if len(delimiter) == 1 and delimiter not in '"\\]^-\'':
+            grammar = f"--grammar 'root ::= [^{delimiter}\\n]+ \"{delimiter}\"' "
+        else:
+            print(botPrint(f'{option}_GRAMMAR needs a single character {option}_TEXT_DELIMITER, running without a grammar.', 'Yellow'))
+
+    # The prompt is passed inside single quotes to the shell
+    prompt_text = build_prompt_text(prompt, option, shell, context).replace("'", "'\\''")
+
     prompt = (
         path.join(llama_cpp_dir)
         + f"main -m  {(llama_model)} -p '"
-        + getenv(option + '_TEXT_START').replace(r'\n', '\n')
-        + prompt
-        + getenv(option + '_TEXT_END').replace(r'\n', '\n')
+        + prompt_text
         + f"' -n {(getenv(option + '_TOKENS'))} -e "
-        + f"--top-p {(getenv(option + '_TOP_P'))} "
+        + f"--top-p {(top_p)} "
         + f"--top-k {(getenv(option + '_TOP_K'))} "
         + f"--ctx-size {(getenv(option + '_CTX'))} "
         + f"--repeat-penalty {(getenv(option + '_R_PENALTY'))} "
+        + sampling
         + gpu_layers
+        + grammar
         + ' --log-disable'
     )
     return prompt
 
 
 # Builder for instancing env variables and generating the prompt
-def run_llama_builder(prompt, option, token = None):
+def run_llama_builder(prompt, option, token = None, shell = None, context = '', policy = None, top_p = None, stop = None, verify_flags = True):
 
     text_delimiter = str(getenv(option + "_TEXT_DELIMITER"))
     text_end = str(getenv(option + "_TEXT_END"))
     token = token if token is not None else getenv(option + '_TOKENS')
+    shell = resolve_shell(shell)
+    stop = stop if stop is not None else (getenv(option + '_STOP') or '')
+    # Everything before this offset in the output is the echoed prompt
+    prompt_text = build_prompt_text(prompt, option, shell, context)
+    generated_start = len(prompt_text)
 
     # Generate the builder passing the variables and getting the envs
-    builder = generate_llama_prompt(prompt, option, token)
+    builder = generate_llama_prompt(prompt, option, token, shell, context, top_p)
+    cache_key = builder + (f' --stop {stop}' if stop else '')
 
-    # Run the llama.cpp in a subprocess
-    llamaOutput = subprocess.Popen(builder, shell=True,stdout=subprocess.PIPE, stdin=subprocess.DEVNULL)
-    
-    # Get the delimiters based on .env variables and stop the llama if anything matches
-    delimiter_count = 0
-    result = None
-    llamaLog = ''
-    i = 0
-    
-    while True:
-        i += 1
-        llamaOutputLine = str(llamaOutput.stdout.readline().decode('utf-8'))
-        llamaLog += llamaOutputLine
-
-        if text_delimiter in llamaOutputLine:
-            delimiter_count += 1
-            if delimiter_count > 1 and text_end == '': # Has a delimiter and dont have end text, probably a question
-                result = llamaOutputLine.replace(text_delimiter, '').strip()
+    # Identical calls can reuse an earlier answer when RESPONSE_CACHE is on
+    use_cache = getenv('RESPONSE_CACHE') == 'YES'
+    result = read_cached_response(cache_key, int(getenv('RESPONSE_CACHE_TTL') or 86400)) if use_cache else None
+    if result is not None:
+        print(botPrint('Answer from the response cache', 'Grey'))
+    else:
+        # Run the llama.cpp in a subprocess
+        llamaOutput = subprocess.Popen(builder, shell=True,stdout=subprocess.PIPE, stdin=subprocess.DEVNULL)
+
+        # Get the delimiters based on .env variables and stop the llama if anything matches
+        delimiter_count = 0
+        llamaLog = ''
+        i = 0
+
+        while result is None:
+            i += 1
+            llamaOutputLine = str(llamaOutput.stdout.readline().decode('utf-8'))
+            llamaLog += llamaOutputLine
+
+            # llama.cpp main only stops at a reverse prompt in interactive mode, so the stop text is enforced here
+            stop_at = llamaLog.find(stop, generated_start) if stop else -1
+            if stop_at != -1:
+                line_start = len(llamaLog) - len(llamaOutputLine)
+                llamaOutputLine = llamaOutputLine[:max(0, stop_at - line_start)]
                 llamaOutput.terminate()
-            elif delimiter_count == 1 and text_end != '': # Has a delimiter and a end text, probably a command
-                result = find_between(llamaOutputLine, text_end, text_delimiter) # Get value between the end text and delimiter to get the command only
+
+            if text_delimiter in llamaOutputLine:
+                delimiter_count += 1
+                if delimiter_count > 1 and text_end == '': # Has a delimiter and dont have end text, probably a question
+                    result = llamaOutputLine.replace(text_delimiter, '').strip()
+                    llamaOutput.terminate()
+                elif delimiter_count == 1 and text_end != '': # Has a delimiter and a end text, probably a command
+                    result = find_between(llamaOutputLine, text_end, text_delimiter) # Get value between the end text and delimiter to get the command only
+                    llamaOutput.terminate()
+            elif i > 5 + prompt_text.count('\n'): # Lines of the echoed prompt, like added context, are not failures
+                print(botPrint('Please, try again!', 'Red'))
                 llamaOutput.terminate()
-        elif i > 5:
-            print(botPrint('Please, try again!', 'Red'))
-            llamaOutput.terminate()
-            break
-        
-        if result is not None:
-            result
-            if option == 'C':
-                run_command(result)
-            else:
-                print(botPrint(result))
-                break
-        else:
-            pass
+                return
+
+            if result is None and stop_at != -1:
+                print(botPrint('Please, try again!', 'Red'))
+                return
+
+        if use_cache:
+            write_cached_response(cache_key, result)
+
+    if option == 'C':
+        # Models often make up flags, check them against the tool's own --help once
+        if getenv('C_VERIFY_FLAGS') == 'YES':
+            flags = unknown_flags(result)
+            if flags and verify_flags:
+                print(botPrint(f"{result.split()[0]} --help does not list {', '.join(flags)}, trying again.", 'Yellow'))
+                context += f"{result.split()[0]} has no {', '.join(flags)} option.\n"
+                return run_llama_builder(prompt, option, token, shell, context, policy, top_p, stop, False)
+            elif flags:
+                print(botPrint(f"Careful, {result.split()[0]} --help does not list {', '.join(flags)}.", 'Yellow'))
+        run_command(result, prompt, shell, policy)
+    else:
+        print(botPrint(result))
+
+# Exit code of anything that needs the network while OFFLINE is set
+offline_exit_code = 3
 
 def run_wiki_summary(param):
+    if (getenv('OFFLINE') == 'YES'):
+        print(botPrint('Offline mode is on, the wiki summary needs the network.', 'Red'))
+        exit(offline_exit_code)
+
     searchParam = quote(param)
     wikiUrl = 'https://en.wikipedia.org/w/api.php?format=json&action=query&prop=extracts&exintro&explaintext&redirects=1&titles='+searchParam
     try:
-        response = get(wikiUrl).json()
+        response = get(wikiUrl, timeout=10).json()
         data = response['query']['pages']
         first_key = next(iter(data))
         if first_key == '-1':
@@ -0,0 +1,41 @@
+from os import getenv, path, makedirs, listdir, remove
+from hashlib import sha256
+import json
+import time
+from .helpers import botPrint
+
+# Responses are cached per llama.cpp call, which holds the model, the whole prompt and every parameter
+def cache_dir():
+    return path.join(getenv('LLAMA_COMPLETION_DIR') or '', 'response_cache')
+
+def cache_path(builder):
+    return path.join(cache_dir(), sha256(builder.encode('utf-8')).hexdigest() + '.json')
+
+def read_cached_response(builder, ttl = 86400):
+    try:
+        with open(cache_path(builder), encoding='utf-8') as file:
+            cached = json.load(file)
+        if time.time() - cached['time'] < ttl:
+            return cached['result']
+    except (OSError, ValueError, KeyError, TypeError):
+        pass
+    return None
+
+def write_cached_response(builder, result):
+    if getenv('READONLY') == 'YES':
+        return
+    try:
+        makedirs(cache_dir(), exist_ok=True)
+        with open(cache_path(builder), 'w', encoding='utf-8') as file:
+            json.dump({'time': time.time(), 'result': result}, file)
+    except OSError:
+        pass
+
+def clear_response_cache():
+    count = 0
+    if path.isdir(cache_dir()):
+        for name in listdir(cache_dir()):
+            if name.endswith('.json'):
+                remove(path.join(cache_dir(), name))
+                count += 1
+    print(botPrint(f'Removed {count} cached responses.'))
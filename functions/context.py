@@ -0,0 +1,166 @@
+from os import environ, getenv, path
+from shutil import which
+import json
+import platform
+import time
+import re
+import shlex
+import subprocess
+import sys
+from .helpers import botPrint
+
+# Keep added context small, the default context window is only a few hundred tokens
+def truncate_context(text, max_chars):
+    if len(text) > max_chars:
+        return text[:max_chars] + '\n(truncated)\n'
+    return text
+
+# Output of a git command, empty outside a repository or when git is missing
+def git_output(args):
+    try:
+        return subprocess.run(['git'] + args, capture_output=True, text=True, timeout=5).stdout.strip()
+    except (OSError, subprocess.TimeoutExpired):
+        return ''
+
+def git_context(max_chars = 1500):
+    # 'status -sb' starts with the branch and its upstream
+    status = git_output(['status', '-sb'])
+    if not status:
+        return ''
+
+    context = 'Git status of the current repository:\n' + status + '\n'
+    commits = git_output(['log', '-5', '--format=%s'])
+    if commits:
+        context += 'Last commits:\n' + commits + '\n'
+    return truncate_context(context, max_chars) + '\n'
+
+# Values of environment variables with these words in their name are never sent
+secret_names = ['TOKEN', 'SECRET', 'PASSWORD', 'PASSWD', 'KEY', 'CREDENTIAL', 'AUTH']
+
+def redact(text):
+    secrets = [value for name, value in environ.items() if len(value) > 3 and any(word in name.upper() for word in secret_names)]
+    secrets += [value.strip() for value in (getenv('ENV_CONTEXT_REDACT') or '').split(',') if value.strip()]
+    for secret in secrets:
+        text = text.replace(secret, '[redacted]')
+    return text
+
+# First line of '<tool> --version', empty when the tool does not support it
+def tool_version(tool):
+    try:
+        version = subprocess.run([tool, '--version'], capture_output=True, text=True, timeout=3, stdin=subprocess.DEVNULL)
+    except (OSError, subprocess.TimeoutExpired):
+        return ''
+    lines = (version.stdout or version.stderr).strip().splitlines()
+    return lines[0] if lines and version.returncode == 0 else ''
+
+# Help text of a tool, or of 'tool subcommand' when the tool lists it, e.g. 'git commit'
+def help_text(words):
+    def run_help(args, flag = '--help'):
+        try:
+            output = subprocess.run(args + [flag], capture_output=True, text=True, timeout=3, stdin=subprocess.DEVNULL, env=dict(environ, PAGER='cat', MANPAGER='cat', GIT_PAGER='cat'))
+        except (OSError, subprocess.TimeoutExpired):
+            return ''
+        return output.stdout + output.stderr
+
+    text = run_help(words[:1])
+    if len(words) > 1 and re.match(r'^[a-z][a-z-]*$', words[1]) and re.search(r'\b' + re.escape(words[1]) + r'\b', text):
+        # 'git commit --help' opens a man page, '-h' prints the option summary
+        return run_help(words[:2]) + run_help(words[:2], '-h')
+    return text
+
+# Flags of the first program in a command that its --help output never mentions
+def unknown_flags(command):
+    try:
+        words = shlex.split(re.split(r'\|\||&&|\||;', command)[0])
+    except ValueError:
+        return []
+    if not words or not which(words[0]):
+        return []
+
+    text = help_text(words)
+    if not text.strip():
+        return []
+
+    unknown = []
+    for word in words[1:]:
+        flag = word.split('=')[0]
+        if not flag.startswith('-') or flag in ['-', '--'] or re.match(r'^-\d+$', flag) or flag in text:
+            continue
+        # Short flags are often grouped, like 'ls -la'
+        if not flag.startswith('--') and all(f'-{letter}' in text for letter in flag[1:]):
+            continue
+        unknown.append(flag)
+    return unknown
+
+def env_context(prompt, max_chars = 1000):
+    context = f'Operating system: {platform.system()} {platform.release()}\n'
+    context += f"Shell: {path.basename(getenv('SHELL') or 'unknown')}\n"
+
+    # Probe the versions of installed tools the question mentions, e.g. 'docker' or 'python3'
+    tools = []
+    for word in re.findall(r'[A-Za-z][A-Za-z0-9_.+-]*', prompt):
+        if word not in tools and len(word) > 1 and which(word):
+            tools.append(word)
+    for tool in tools[:5]:
+        version = tool_version(tool)
+        if version:
+            context += f'{tool} version: {version}\n'
+
+    return truncate_context(redact('Environment:\n' + context), max_chars) + '\n'
+
+# Attached files share one budget in the order they were given, '-' reads stdin
+def attach_context(names, max_chars = 2000):
+    context = ''
+    truncated = []
+    for name in names:
+        label = 'stdin' if name == '-' else name
+        try:
+            if name == '-':
+                text = sys.stdin.read()
+            else:
+                with open(name, encoding='utf-8', errors='replace') as file:
+                    text = file.read()
+        except OSError as error:
+            print(botPrint(f'Could not attach {label}: {error.strerror}', 'Red'))
+            sys.exit(1)
+
+        budget = max_chars - len(context)
+        if len(text) > budget:
+            truncated.append(f'{label} ({max(budget, 0)} of {len(text)} characters)')
+            text = text[:max(budget, 0)]
+        context += f'--- {label} ---\n{text.strip()}\n--- end of {label} ---\n'
+
+    if truncated:
+        print(botPrint('Attachments were cut to fit the budget: ' + ', '.join(truncated), 'Yellow'))
+    return context + '\n'
+
+# Which of the given tools are on PATH, cached in LLAMA_COMPLETION_DIR for ttl seconds
+def probe_tools(tools, ttl = 86400):
+    cache_path = path.join(getenv('LLAMA_COMPLETION_DIR') or '', 'tools_cache.json')
+    try:
+        with open(cache_path, encoding='utf-8') as file:
+            cache = json.load(file)
+        if time.time() - cache['time'] < ttl and all(tool in cache['tools'] for tool in tools):
+            return {tool: cache['tools'][tool] for tool in tools}
+    except (OSError, ValueError, KeyError, TypeError):
+        pass
+
+    found = {tool: which(tool) is not None for tool in tools}
+    if getenv('READONLY') != 'YES':
+        try:
+            with open(cache_path, 'w', encoding='utf-8') as file:
+                json.dump({'time': time.time(), 'tools': found}, file)
+        except OSError:
+            pass
+    return found
+
+def tools_context(tools, ttl = 86400):
+    found = probe_tools(tools, ttl)
+    installed = [tool for tool in tools if found[tool]]
+    missing = [tool for tool in tools if not found[tool]]
+    context = ''
+    if installed:
+        context += 'Available tools: ' + ', '.join(installed) + '.\n'
+    if missing:
+        context += 'Not installed, do not use: ' + ', '.join(missing) + '.\n'
+    return context
@@ -1,3 +1,7 @@
+from os import path
+import re
+import sys
+
 def find_between( s, first, last ):
     try:
         start = s.index( first ) + len( first )
@@ -6,6 +10,122 @@ def find_between( s, first, last ):
     except ValueError:
         return ""
 
+# Programs that take over the terminal and would hang waiting for input
+interactive_commands = [
+    'top', 'htop', 'btop', 'vi', 'vim', 'nvim', 'nano', 'emacs', 'less', 'more',
+    'man', 'ssh', 'telnet', 'ftp', 'sftp', 'mysql', 'psql', 'sqlite3', 'watch',
+    'tmux', 'screen',
+]
+
+# Programs that run the rest of their arguments as a command, with the options that take a separate value
+wrapper_commands = {
+    'sudo': ['-u', '-g', '-h', '-p', '-C', '-D', '-R', '-T', '-U'],
+    'env': ['-u', '-C', '-S'],
+    'time': ['-f', '-o'],
+    'nohup': [],
+    'nice': ['-n'],
+    'xargs': ['-a', '-d', '-E', '-I', '-L', '-n', '-P', '-s'],
+    'exec': ['-a'],
+    'command': [],
+}
+
+def segment_words(segment):
+    # Subshells and groups like '(vim x)' or '{ vim x; }'
+    words = segment.strip().lstrip('({').split()
+    while words:
+        # Skip environment assignments like 'EDITOR=vim git commit'
+        if re.match(r'^[A-Za-z_][A-Za-z0-9_]*=', words[0]):
+            words = words[1:]
+        elif path.basename(words[0]) in wrapper_commands:
+            value_options = wrapper_commands[path.basename(words[0])]
+            words = words[1:]
+            while words and words[0].startswith('-'):
+                option = words[0]
+                words = words[1:]
+                if option in value_options and words:
+                    words = words[1:]
+        else:
+            return words
+    return []
+
+# git commands that open an editor or prompt, e.g. 'git commit' without a message
+def is_interactive_git(words):
+    if 'commit' in words:
+        # Only options after the subcommand matter, 'git -C repo commit' still opens an editor
+        words = words[words.index('commit') + 1:]
+        return not any(
+            word.startswith(('--message', '--file', '--no-edit', '--reuse-message', '--fixup'))
+            or (re.match(r'^-[A-Za-z]+$', word) and re.search(r'[mFC]', word))
+            for word in words
+        )
+    if 'rebase' in words:
+        return '-i' in words or '--interactive' in words
+    if 'add' in words:
+        return any(word in ['-p', '-i', '--patch', '--interactive'] for word in words)
+    return False
+
+def is_segment_interactive(segment):
+    words = segment_words(segment)
+    if not words:
+        return False
+    program = path.basename(words[0]).rstrip(')}')
+    if program == 'git':
+        return is_interactive_git(words[1:])
+    return program in interactive_commands
+
+# Check every program in a pipeline or command list, e.g. 'cd /etc && vim hosts'
+def is_interactive_command(command):
+    segments = re.split(r'\|\||&&|\||;|&|\n', command)
+    return any(is_segment_interactive(segment) for segment in segments)
+
+# Commands that delete data, change ownership or take the machine down
+dangerous_patterns = [
+    r'\brm\s', r'\bdd\s', r'\bmkfs', r'\b(shutdown|reboot|poweroff|halt)\b',
+    r'\b(fdisk|parted|wipefs)\b', r'\b(kill|killall|pkill)\s', r'\b(chmod|chown)\s+-\w*R',
+    r'\bsudo\s', r'\bgit\s+(push\s.*(-f\b|--force)|reset\s+--hard|clean\s+-\w*f)',
+    r'>\s*/dev/sd', r'\|\s*(sudo\s+)?(sh|bash)\b',
+]
+
+def is_dangerous_command(command):
+    return any(re.search(pattern, command) for pattern in dangerous_patterns)
+
+# Words that start a request for a command, like 'list all files bigger than 1GB'
+command_verbs = [
+    'list', 'find', 'show', 'delete', 'remove', 'copy', 'move', 'rename', 'create', 'make',
+    'count', 'kill', 'stop', 'start', 'restart', 'compress', 'extract', 'unzip', 'download',
+    'install', 'uninstall', 'update', 'upgrade', 'search', 'print', 'display', 'open', 'run',
+    'change', 'set', 'get', 'check', 'convert', 'replace', 'sort', 'clone', 'push', 'pull',
+]
+
+# Guess whether free text is a question (Q) or a request for a command (C)
+def guess_mode(text):
+    words = text.lower().split()
+    if not words:
+        return 'Q'
+    # Pasted errors are questions about what went wrong
+    if re.search(r'\b(error|exception|traceback|failed|not found|denied)\b', text.lower()):
+        return 'Q'
+    if words[0] in command_verbs:
+        return 'C'
+    if re.match(r'^(how (do|can|would) (i|you|we)|how to) ', text.lower()):
+        return 'C'
+    return 'Q'
+
+# Ask a y/N question. Without a terminal to answer from, the answer is no.
+def confirm(question, assume_yes = False, stdin = None):
+    stdin = stdin if stdin is not None else sys.stdin
+    if assume_yes:
+        return True
+
+    if stdin is sys.stdin and not stdin.isatty():
+        print(botPrint('No terminal to confirm from, assuming no.', 'Grey'))
+        return False
+
+    print(botPrint(question + ' (y/N)', 'Yellow'))
+
+    answer = stdin.readline().strip()
+    return answer == 'Y' or answer == 'y'
+
 def botPrint(value, color_schema = 'Green'):
 
     normal_color = "\033[0m"
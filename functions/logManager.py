@@ -1,4 +1,63 @@
-llama_completion_dir = getenv("LLAMA_COMPLETION_DIR")
-from os import getenv
+from os import getenv, path, makedirs
+from datetime import datetime
+from dotenv import dotenv_values, find_dotenv
+from sys import argv
+import platform
+import re
+from .helpers import botPrint
+from .cli import version
+from .context import redact
 
-# Log will be added soon
\ No newline at end of file
+# Read at call time, the .env file is loaded after this module is imported
+def audit_log_path():
+    return path.join(getenv('LLAMA_COMPLETION_DIR') or '', getenv('AUDIT_LOG') or 'audit_log.txt')
+
+# Keep each entry on a single line so the fields can be split again
+def escape_field(value):
+    return str(value).replace('\\', '\\\\').replace('\t', '\\t').replace('\n', '\\n').replace('\r', '\\r')
+
+def unescape_field(value):
+    escapes = {'\\': '\\', 't': '\t', 'n': '\n', 'r': '\r'}
+    return re.sub(r'\\(.)', lambda match: escapes.get(match.group(1), match.group(0)), value)
+
+# Append one tab separated line per executed command
+def write_audit_log(command, description, exit_code):
+    timestamp = datetime.now().strftime('%Y-%m-%d %H:%M:%S')
+    with open(audit_log_path(), 'a', encoding='utf-8') as log:
+        log.write(f"{timestamp}\t{exit_code}\t{escape_field(description)}\t{escape_field(command)}\n")
+
+def show_audit_log():
+    if not path.exists(audit_log_path()):
+        print(botPrint('No commands have been executed yet.', 'Grey'))
+        return
+
+    with open(audit_log_path(), encoding='utf-8') as log:
+        for line in log:
+            fields = line.rstrip('\n').split('\t', 3)
+            # Skip damaged or hand edited lines instead of failing on the whole log
+            if len(fields) < 4:
+                continue
+            timestamp, exit_code, description, command = fields
+            description, command = unescape_field(description), unescape_field(command)
+            color = 'Green' if exit_code == '0' else 'Red'
+            print(botPrint(timestamp, 'Grey') + ' ' + botPrint(f'[{exit_code}]', color) + ' ' + botPrint(command, 'White'))
+            print('    ' + botPrint(description, 'Grey'))
+
+# Local crash report for bug reports, nothing is uploaded anywhere
+def write_crash_report(trace):
+    timestamp = datetime.now()
+    report_dir = path.join(getenv('LLAMA_COMPLETION_DIR') or '', 'crash_reports')
+    makedirs(report_dir, exist_ok=True)
+    report_path = path.join(report_dir, timestamp.strftime('crash_%Y%m%d_%H%M%S.txt'))
+
+    config = dotenv_values(find_dotenv())
+    report = f"Time: {timestamp.strftime('%Y-%m-%d %H:%M:%S')}\n"
+    report += f'Version: {version}\n'
+    report += f'Python: {platform.python_version()} on {platform.system()} {platform.release()}\n'
+    report += 'Arguments: ' + ' '.join(argv[1:]) + '\n\n'
+    report += 'Config:\n' + ''.join(f'{key}={value}\n' for key, value in config.items()) + '\n'
+    report += trace
+
+    with open(report_path, 'w', encoding='utf-8') as file:
+        file.write(redact(report))
+    return report_path
@@ -0,0 +1,43 @@
+from os import getenv, path
+from .helpers import botPrint
+from .context import truncate_context
+
+# Facts to remember across runs, one per line
+def memory_path():
+    return path.join(getenv('LLAMA_COMPLETION_DIR') or '', getenv('MEMORY_FILE') or 'memory.txt')
+
+def read_memory():
+    try:
+        with open(memory_path(), encoding='utf-8') as memory:
+            return [line.strip() for line in memory if line.strip()]
+    except OSError:
+        return []
+
+def remember(fact):
+    fact = ' '.join(fact.split())
+    with open(memory_path(), 'a', encoding='utf-8') as memory:
+        memory.write(fact + '\n')
+    print(botPrint(f'Remembered: {fact}'))
+
+def show_memory():
+    facts = read_memory()
+    if not facts:
+        print(botPrint('Nothing remembered yet.', 'Grey'))
+    for number, fact in enumerate(facts, 1):
+        print(botPrint(f'{number}.', 'Grey') + ' ' + botPrint(fact, 'White'))
+
+def forget(number):
+    facts = read_memory()
+    if number < 1 or number > len(facts):
+        print(botPrint(f'There is no fact number {number}, see --memory for the list.', 'Red'))
+        exit(1)
+    fact = facts.pop(number - 1)
+    with open(memory_path(), 'w', encoding='utf-8') as memory:
+        memory.write(''.join(fact + '\n' for fact in facts))
+    print(botPrint(f'Forgot: {fact}'))
+
+def memory_context(max_chars = 500):
+    facts = read_memory()
+    if not facts:
+        return ''
+    return truncate_context('Facts about the user:\n' + ''.join(f'- {fact}\n' for fact in facts), max_chars) + '\n'
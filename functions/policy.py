@@ -0,0 +1,45 @@
+from os import path
+import re
+from .helpers import botPrint
+
+# Settings an administrator can force for every user, optionally in a root owned file
+policy_file = '/etc/llama-terminal-completion/policy.env'
+
+policy_values = {
+    'READONLY': ['YES', 'NO'],
+    'OFFLINE': ['YES', 'NO'],
+    'C_CONFIRM_POLICY': ['always', 'dangerous', 'never'],
+    'C_SHELL_HISTORY': None,
+    'ENV_CONTEXT_REDACT': None,
+}
+
+# A policy that can not be read or parsed stops the script instead of being ignored
+def load_policy(file = policy_file):
+    if not path.exists(file):
+        return {}
+
+    def refuse(reason):
+        print(botPrint(f'The policy file {file} {reason}, refusing to run.', 'Red'))
+        exit(1)
+
+    try:
+        with open(file, encoding='utf-8') as policy:
+            lines = policy.read().splitlines()
+    except OSError as error:
+        refuse(f'can not be read ({error.strerror})')
+
+    settings = {}
+    for number, line in enumerate(lines, 1):
+        line = line.strip()
+        if not line or line.startswith('#'):
+            continue
+        match = re.match(r'^([A-Z_]+)=(.*)$', line)
+        if not match or match.group(1) not in policy_values:
+            refuse(f'has an unknown setting on line {number}')
+        name, value = match.group(1), match.group(2).strip().strip('\'"')
+        if policy_values[name] is not None and value not in policy_values[name]:
+            refuse(f'has an invalid value for {name} on line {number}')
+        if name == 'C_SHELL_HISTORY' and not value.isdigit():
+            refuse(f'has an invalid value for {name} on line {number}')
+        settings[name] = value
+    return settings